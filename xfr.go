@@ -5,6 +5,7 @@
 package dns
 
 import (
+	"errors"
 	"net"
 	"time"
 )
@@ -15,24 +16,50 @@ type Envelope struct {
 	Error error // If something went wrong, this contains the error.
 }
 
-// A Transfer defines parameters that are used during a zone transfer. 
+// A Transfer defines parameters that are used during a zone transfer.
 type Transfer struct {
 	*Conn
-	DialTimeout    time.Duration // net.DialTimeout (ns), defaults to 2 * 1e9
-	ReadTimeout    time.Duration // net.Conn.SetReadTimeout value for connections (ns), defaults to 2 * 1e9
-	WriteTimeout   time.Duration // net.Conn.SetWriteTimeout value for connections (ns), defaults to 2 * 1e9
+	DialTimeout    time.Duration     // net.DialTimeout (ns), defaults to 2 * 1e9
+	ReadTimeout    time.Duration     // net.Conn.SetReadTimeout value for connections (ns), defaults to 2 * 1e9
+	WriteTimeout   time.Duration     // net.Conn.SetWriteTimeout value for connections (ns), defaults to 2 * 1e9
 	TsigSecret     map[string]string // Secret(s) for Tsig map[<zonename>]<base64 secret>, zonename must be fully qualified
+	Net            string            // If not blank, the used net, defaults to "tcp"
+	PreferUDPIXFR  bool              // If true, an IXFR query is attempted over UDP first, falling back to TCP per RFC 1995
 	tsigTimersOnly bool
 }
 
 // In performs an incoming transfer with the server in a.
+//
+// If PreferUDPIXFR is set and q is an IXFR query, the query is first sent over UDP. If the
+// UDP reply is truncated, or does not carry the full IXFR delta, In transparently reopens the
+// connection over TCP, reissues the query and continues the transfer there; the resulting
+// envelopes, whichever transport produced them, are all delivered on the returned channel.
 func (t *Transfer) In(q *Msg, a string) (env chan *Envelope, err error) {
-	t.Conn = new(Conn)
 	timeout := dnsTimeout
 	if t.DialTimeout != 0 {
 		timeout = t.DialTimeout
 	}
-	t.Conn.Conn, err = net.DialTimeout("tcp", a, timeout)
+
+	if q.Question[0].Qtype == TypeIXFR && t.PreferUDPIXFR {
+		t.Conn = new(Conn)
+		t.Conn.Conn, err = net.DialTimeout("udp", a, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.WriteMsg(q); err != nil {
+			return nil, err
+		}
+		env = make(chan *Envelope)
+		go t.inIxfrUDP(q, a, env)
+		return env, nil
+	}
+
+	network := t.Net
+	if network == "" {
+		network = "tcp"
+	}
+	t.Conn = new(Conn)
+	t.Conn.Conn, err = net.DialTimeout(network, a, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -53,6 +80,61 @@ func (t *Transfer) In(q *Msg, a string) (env chan *Envelope, err error) {
 	return env, nil
 }
 
+// inIxfrUDP reads the single UDP reply to an IXFR query sent by In. If the reply is truncated,
+// or its framing shows the server wants the transfer continued elsewhere, it falls back to a
+// TCP AXFR/IXFR over a, re-sending q and delivering the rest of the envelopes on c.
+func (t *Transfer) inIxfrUDP(q *Msg, a string, c chan *Envelope) {
+	timeout := dnsTimeout
+	if t.ReadTimeout != 0 {
+		timeout = t.ReadTimeout
+	}
+	t.Conn.SetReadDeadline(time.Now().Add(timeout))
+	in, err := t.ReadMsg()
+	t.Conn.Close()
+	if err == nil && q.Id == in.Id && !in.Truncated && isSOAFirst(in) {
+		if len(in.Answer) == 1 {
+			// No changes.
+			c <- &Envelope{in.Answer, nil}
+			close(c)
+			return
+		}
+		if v, ok := in.Answer[len(in.Answer)-1].(*SOA); ok && v.Serial == in.Answer[0].(*SOA).Serial {
+			// The condensed reply form: the whole delta, framed at both ends by the
+			// server's current SOA, fit in a single UDP message.
+			c <- &Envelope{in.Answer, nil}
+			close(c)
+			return
+		}
+	}
+
+	// Either the UDP attempt failed outright, was truncated, or the server prefers the
+	// transfer continue over TCP; reopen the connection there and retry the query.
+	dialTimeout := dnsTimeout
+	if t.DialTimeout != 0 {
+		dialTimeout = t.DialTimeout
+	}
+	network := t.Net
+	if network == "" {
+		network = "tcp"
+	}
+	t.Conn = new(Conn)
+	t.Conn.Conn, err = net.DialTimeout(network, a, dialTimeout)
+	if err != nil {
+		c <- &Envelope{nil, err}
+		close(c)
+		return
+	}
+	// The UDP attempt may have left a request MAC from the aborted exchange; this is a new
+	// connection and the query must be signed as the start of a fresh TSIG session.
+	t.tsigRequestMAC = ""
+	if err := t.WriteMsg(q); err != nil {
+		c <- &Envelope{nil, err}
+		close(c)
+		return
+	}
+	t.inIxfr(q.Id, c)
+}
+
 func (t *Transfer) inAxfr(id uint16, c chan *Envelope) {
 	first := true
 	defer t.Close()
@@ -150,8 +232,6 @@ func (t *Transfer) inIxfr(id uint16, c chan *Envelope) {
 	}
 }
 
-
-
 // Out performs an outgoing transfer with the client connecting in w.
 // Basic use pattern:
 //
@@ -185,6 +265,179 @@ func (t *Transfer) Out(w ResponseWriter, q *Msg, ch chan *Envelope) error {
 	return nil
 }
 
+// oneRRIter returns an rrIter that yields rr once.
+func oneRRIter(rr RR) func() (RR, bool) {
+	done := false
+	return func() (RR, bool) {
+		if done {
+			return nil, false
+		}
+		done = true
+		return rr, true
+	}
+}
+
+// sliceRRIter returns an rrIter that yields the RRs in rrs in order.
+func sliceRRIter(rrs []RR) func() (RR, bool) {
+	i := 0
+	return func() (RR, bool) {
+		if i >= len(rrs) {
+			return nil, false
+		}
+		rr := rrs[i]
+		i++
+		return rr, true
+	}
+}
+
+// chainRRIter returns an rrIter that yields everything iters[0] yields, then everything
+// iters[1] yields, and so on.
+func chainRRIter(iters ...func() (RR, bool)) func() (RR, bool) {
+	return func() (RR, bool) {
+		for len(iters) > 0 {
+			if rr, ok := iters[0](); ok {
+				return rr, true
+			}
+			iters = iters[1:]
+		}
+		return nil, false
+	}
+}
+
+// OutAXFR performs an outgoing AXFR transfer with the client connecting in w, sourcing the
+// zone from rrIter. rrIter must yield the zone's SOA first, then the remaining RRs, returning
+// ok == false once the zone is exhausted. Unlike Out, OutAXFR takes care of the envelope
+// framing itself: it packs the RRs greedily into as few messages as MaxMsgSize (and any TSIG
+// overhead) allows, splitting the zone across multiple messages when needed, and repeats the
+// SOA at the start and the end of the transfer. rrIter is streamed straight into the packer,
+// so the zone is never buffered in full.
+//
+// OutAXFR writes synchronously and returns once the transfer is done; as with Out, the caller
+// is responsible for calling w.Hijack() before returning from the handler, and for closing the
+// connection afterwards.
+func (t *Transfer) OutAXFR(w ResponseWriter, q *Msg, rrIter func() (RR, bool)) error {
+	soa, ok := rrIter()
+	if !ok || soa.Header().Rrtype != TypeSOA {
+		return ErrSoa
+	}
+
+	r := new(Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	return t.outEnvelopes(w, r, chainRRIter(oneRRIter(soa), rrIter, oneRRIter(soa)))
+}
+
+// IxfrDiff is a single version-to-version delta of a zone, as used by OutIXFR. Remove and Add
+// list the RRs removed and added to move the zone from the previous version to NewSerial. If
+// TooBig is set (for instance because the journal for this version was compacted away), Remove
+// and Add are ignored and Records must hold a full, freshly generated zone matching NewSerial
+// (SOA first, then the other RRs, as accepted by OutAXFR's rrIter; the closing SOA is added
+// by OutAXFR and must not be in Records); OutIXFR then sends Records AXFR-style
+// instead of the incremental framing. TooBig may only be set on the last diff in the slice —
+// every later diff's Add/Remove would otherwise have to be replayed on top of it, which OutIXFR
+// does not do.
+type IxfrDiff struct {
+	NewSerial uint32
+	Remove    []RR
+	Add       []RR
+	TooBig    bool
+	Records   []RR
+}
+
+// ErrIxfrTooBig is returned by OutIXFR when a diff earlier than the last one in the chain has
+// TooBig set.
+var ErrIxfrTooBig = errors.New("dns: IxfrDiff.TooBig set on a non-final diff")
+
+// OutIXFR performs an outgoing IXFR transfer with the client connecting in w, as described in
+// RFC 1995. soa is the zone's current SOA, oldSerial is the serial the client already has, and
+// diffs are the sequential per-version deltas needed to bring the client from oldSerial to
+// soa.Serial, oldest first. OutIXFR emits the (old SOA, deletions, new SOA, additions)+ framing
+// for diffs, packing messages the same way OutAXFR does; if the last diff has TooBig set, the
+// transfer falls back to sending that diff's Records as a plain AXFR instead. If oldSerial
+// already equals soa.Serial, OutIXFR sends the standard single-SOA "no changes" reply instead
+// of an empty diff chain.
+//
+// As with OutAXFR, OutIXFR writes synchronously and returns once the transfer is done; the
+// caller is responsible for calling w.Hijack() before returning from the handler, and for
+// closing the connection afterwards.
+func (t *Transfer) OutIXFR(w ResponseWriter, q *Msg, soa *SOA, oldSerial uint32, diffs []IxfrDiff) error {
+	if oldSerial == soa.Serial {
+		r := new(Msg)
+		r.SetReply(q)
+		r.Authoritative = true
+		return t.outEnvelopes(w, r, oneRRIter(soa))
+	}
+
+	for i, d := range diffs {
+		if !d.TooBig {
+			continue
+		}
+		if i != len(diffs)-1 {
+			return ErrIxfrTooBig
+		}
+		return t.OutAXFR(w, q, sliceRRIter(d.Records))
+	}
+
+	iters := make([]func() (RR, bool), 0, 2+4*len(diffs))
+	iters = append(iters, oneRRIter(soa))
+	serial := oldSerial
+	for _, d := range diffs {
+		oldSOA := new(SOA)
+		*oldSOA = *soa
+		oldSOA.Serial = serial
+
+		newSOA := new(SOA)
+		*newSOA = *soa
+		newSOA.Serial = d.NewSerial
+
+		iters = append(iters, oneRRIter(oldSOA), sliceRRIter(d.Remove), oneRRIter(newSOA), sliceRRIter(d.Add))
+		serial = d.NewSerial
+	}
+	iters = append(iters, oneRRIter(soa))
+
+	r := new(Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	return t.outEnvelopes(w, r, chainRRIter(iters...))
+}
+
+// outEnvelopes writes the RRs yielded by rrIter to w as a sequence of DNS messages based on r,
+// keeping each message under MaxMsgSize (minus some slack for TSIG, when TsigSecret is set) and
+// signing every message after the first with tsigTimersOnly, per RFC 8945. rrIter is packed and
+// flushed as it is consumed, rather than buffered up front.
+func (t *Transfer) outEnvelopes(w ResponseWriter, r *Msg, rrIter func() (RR, bool)) error {
+	max := MaxMsgSize
+	if t.TsigSecret != nil {
+		max -= 100 // Rough upper bound on the size of the TSIG RR itself.
+	}
+
+	r.Answer = make([]RR, 0, 1)
+	for {
+		rr, ok := rrIter()
+		if !ok {
+			break
+		}
+		r.Answer = append(r.Answer, rr)
+		if r.Len() > max && len(r.Answer) > 1 {
+			last := r.Answer[len(r.Answer)-1]
+			r.Answer = r.Answer[:len(r.Answer)-1]
+			if err := w.WriteMsg(r); err != nil {
+				return err
+			}
+			t.tsigTimersOnly = true
+			w.TsigTimersOnly(true)
+			r.Answer = []RR{last}
+		}
+	}
+	if err := w.WriteMsg(r); err != nil {
+		return err
+	}
+	t.tsigTimersOnly = true
+	w.TsigTimersOnly(true)
+	r.Answer = nil
+	return nil
+}
+
 // ReadMsg reads a message from the transfer connection t.
 func (t *Transfer) ReadMsg() (*Msg, error) {
 	m := new(Msg)
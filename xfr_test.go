@@ -0,0 +1,414 @@
+// Copyright 2011 Miek Gieben. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testSOA(name string, serial uint32) *SOA {
+	return &SOA{
+		Hdr:     RR_Header{Name: name, Rrtype: TypeSOA, Class: ClassINET, Ttl: 3600},
+		Ns:      "ns1." + name,
+		Mbox:    "hostmaster." + name,
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   1800,
+		Expire:  604800,
+		Minttl:  3600,
+	}
+}
+
+// TestInIxfrUDPCondensed checks that a non-truncated UDP reply that begins and ends with the
+// server's current SOA, and so holds the whole delta in a single message, is delivered as one
+// envelope, without ever dialing TCP.
+func TestInIxfrUDPCondensed(t *testing.T) {
+	soa := testSOA("miek.nl.", 2)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to run test server: %s", err)
+	}
+	defer pc.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, MaxMsgSize)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		q := new(Msg)
+		if err := q.Unpack(buf[:n]); err != nil {
+			return
+		}
+
+		r := new(Msg)
+		r.SetReply(q)
+		// The condensed form begins and ends on the current/new SOA, not the old one.
+		r.Answer = []RR{soa, soa}
+		out, err := r.Pack()
+		if err != nil {
+			return
+		}
+		pc.WriteTo(out, addr)
+	}()
+
+	tr := &Transfer{PreferUDPIXFR: true}
+	q := new(Msg)
+	q.SetQuestion("miek.nl.", TypeIXFR)
+	q.Ns = []RR{soa}
+
+	env, err := tr.In(q, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unable to run transfer: %s", err)
+	}
+
+	e := <-env
+	if e.Error != nil {
+		t.Fatalf("unexpected envelope error: %s", e.Error)
+	}
+	if len(e.RR) != 2 {
+		t.Fatalf("expected a single condensed envelope with 2 RRs, got %d", len(e.RR))
+	}
+	if _, ok := <-env; ok {
+		t.Fatal("expected only one envelope on the channel")
+	}
+
+	<-done
+}
+
+// TestInIxfrUDPTruncatedFallback checks that a truncated UDP reply makes In retry the query
+// over TCP and deliver the envelopes produced there.
+func TestInIxfrUDPTruncatedFallback(t *testing.T) {
+	soa := testSOA("miek.nl.", 1)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to run test udp server: %s", err)
+	}
+	defer pc.Close()
+
+	// The TCP fallback redials the same address string passed to In, so the listener must
+	// share the UDP socket's port.
+	_, port, err := net.SplitHostPort(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unable to parse udp address: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf("unable to run test tcp server: %s", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		buf := make([]byte, MaxMsgSize)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		q := new(Msg)
+		if err := q.Unpack(buf[:n]); err != nil {
+			return
+		}
+		r := new(Msg)
+		r.SetReply(q)
+		r.Truncated = true
+		out, err := r.Pack()
+		if err != nil {
+			return
+		}
+		pc.WriteTo(out, addr)
+	}()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := &Conn{Conn: conn}
+		q, err := tc.ReadMsg()
+		if err != nil {
+			return
+		}
+		r := new(Msg)
+		r.SetReply(q)
+		r.Answer = []RR{soa}
+		tc.WriteMsg(r)
+	}()
+
+	tr := &Transfer{PreferUDPIXFR: true}
+	q := new(Msg)
+	q.SetQuestion("miek.nl.", TypeIXFR)
+	q.Ns = []RR{soa}
+
+	env, err := tr.In(q, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unable to run transfer: %s", err)
+	}
+
+	e, ok := <-env
+	if !ok {
+		t.Fatal("expected an envelope from the TCP fallback")
+	}
+	if e.Error != nil {
+		t.Fatalf("unexpected envelope error: %s", e.Error)
+	}
+	if len(e.RR) != 1 {
+		t.Fatalf("expected the no-changes SOA envelope, got %d RRs", len(e.RR))
+	}
+}
+
+// TestInIxfrUDPTruncatedFallbackTsig checks that, after a truncated UDP reply triggers the TCP
+// fallback, the re-issued TCP query is freshly TSIG-signed rather than chained off the aborted
+// UDP exchange's request MAC, and that the signed TCP reply verifies against it.
+func TestInIxfrUDPTruncatedFallbackTsig(t *testing.T) {
+	const keyname = "axfr."
+	const secret = "so6ZGir4GPAqINNh9U5c3A=="
+
+	soa := testSOA("miek.nl.", 1)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to run test udp server: %s", err)
+	}
+	defer pc.Close()
+
+	_, port, err := net.SplitHostPort(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unable to parse udp address: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf("unable to run test tcp server: %s", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		buf := make([]byte, MaxMsgSize)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		q := new(Msg)
+		if err := q.Unpack(buf[:n]); err != nil {
+			return
+		}
+		r := new(Msg)
+		r.SetReply(q)
+		r.Truncated = true
+		out, err := r.Pack()
+		if err != nil {
+			return
+		}
+		pc.WriteTo(out, addr)
+	}()
+
+	verifyErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			verifyErr <- err
+			return
+		}
+		defer conn.Close()
+
+		// A Transfer's tsigRequestMAC starts empty, matching what a fresh TCP session
+		// expects from the reissued query; if the UDP attempt's MAC leaked through,
+		// ReadMsg's TsigVerify would fail here.
+		srv := &Transfer{Conn: &Conn{Conn: conn}, TsigSecret: map[string]string{keyname: secret}}
+		q, err := srv.ReadMsg()
+		verifyErr <- err
+		if err != nil {
+			return
+		}
+
+		if ts := q.IsTsig(); ts != nil {
+			srv.tsigRequestMAC = ts.MAC
+		}
+		r := new(Msg)
+		r.SetReply(q)
+		r.Answer = []RR{soa}
+		r.SetTsig(keyname, HmacMD5, 300, time.Now().Unix())
+		srv.WriteMsg(r)
+	}()
+
+	tr := &Transfer{PreferUDPIXFR: true, TsigSecret: map[string]string{keyname: secret}}
+	q := new(Msg)
+	q.SetQuestion("miek.nl.", TypeIXFR)
+	q.Ns = []RR{soa}
+	q.SetTsig(keyname, HmacMD5, 300, time.Now().Unix())
+
+	env, err := tr.In(q, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unable to run transfer: %s", err)
+	}
+
+	if err := <-verifyErr; err != nil {
+		t.Fatalf("TCP fallback query failed to verify: %s", err)
+	}
+
+	e, ok := <-env
+	if !ok {
+		t.Fatal("expected an envelope from the TCP fallback")
+	}
+	if e.Error != nil {
+		t.Fatalf("unexpected envelope error: %s", e.Error)
+	}
+}
+
+// fakeResponseWriter records the messages written to it and the TsigTimersOnly toggles, so
+// OutAXFR/OutIXFR's packing can be inspected without a real network connection.
+type fakeResponseWriter struct {
+	msgs       []*Msg
+	timersOnly []bool
+}
+
+func (w *fakeResponseWriter) LocalAddr() net.Addr         { return nil }
+func (w *fakeResponseWriter) RemoteAddr() net.Addr        { return nil }
+func (w *fakeResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *fakeResponseWriter) Close() error                { return nil }
+func (w *fakeResponseWriter) TsigStatus() error           { return nil }
+func (w *fakeResponseWriter) Hijack()                     {}
+func (w *fakeResponseWriter) TsigTimersOnly(b bool)       { w.timersOnly = append(w.timersOnly, b) }
+func (w *fakeResponseWriter) WriteMsg(m *Msg) error {
+	cp := *m
+	cp.Answer = append([]RR(nil), m.Answer...)
+	w.msgs = append(w.msgs, &cp)
+	return nil
+}
+
+// TestOutAXFRSplitsAtMaxMsgSize checks that a zone too large for one message is split across
+// several, each kept under MaxMsgSize, with the zone's SOA repeated at the tail of the last
+// one.
+func TestOutAXFRSplitsAtMaxMsgSize(t *testing.T) {
+	soa := testSOA("miek.nl.", 1)
+	var rrs []RR
+	for i := 0; i < 2000; i++ {
+		rrs = append(rrs, testSOA("miek.nl.", uint32(i)))
+	}
+	i := 0
+	rrIter := func() (RR, bool) {
+		if i == 0 {
+			i++
+			return soa, true
+		}
+		if i-1 >= len(rrs) {
+			return nil, false
+		}
+		rr := rrs[i-1]
+		i++
+		return rr, true
+	}
+
+	w := new(fakeResponseWriter)
+	q := new(Msg)
+	q.SetQuestion("miek.nl.", TypeAXFR)
+
+	tr := new(Transfer)
+	if err := tr.OutAXFR(w, q, rrIter); err != nil {
+		t.Fatalf("OutAXFR failed: %s", err)
+	}
+
+	if len(w.msgs) < 2 {
+		t.Fatalf("expected the zone to be split across multiple messages, got %d", len(w.msgs))
+	}
+	for _, m := range w.msgs {
+		buf, err := m.Pack()
+		if err != nil {
+			t.Fatalf("unable to pack message: %s", err)
+		}
+		if len(buf) > MaxMsgSize {
+			t.Fatalf("message of %d bytes exceeds MaxMsgSize", len(buf))
+		}
+	}
+	last := w.msgs[len(w.msgs)-1].Answer
+	if rr, ok := last[len(last)-1].(*SOA); !ok || rr != soa {
+		t.Fatal("expected the closing SOA in the last message")
+	}
+
+	// Every message after the first must be signed with tsigTimersOnly, per RFC 8945.
+	if len(w.timersOnly) != len(w.msgs) {
+		t.Fatalf("expected %d TsigTimersOnly calls, got %d", len(w.msgs), len(w.timersOnly))
+	}
+	for i := 1; i < len(w.msgs); i++ {
+		// The toggle is recorded after each write, so timersOnly[i-1] precedes message i.
+		if !w.timersOnly[i-1] {
+			t.Fatalf("expected TsigTimersOnly(true) before message %d", i)
+		}
+	}
+}
+
+// TestOutIXFRNonFinalTooBig checks that OutIXFR refuses a diffs slice where a TooBig diff is
+// not the last one, rather than silently dropping the diffs that follow it.
+func TestOutIXFRNonFinalTooBig(t *testing.T) {
+	soa := testSOA("miek.nl.", 3)
+	diffs := []IxfrDiff{
+		{NewSerial: 2, TooBig: true, Records: []RR{testSOA("miek.nl.", 1), soa}},
+		{NewSerial: 3, Add: []RR{testSOA("miek.nl.", 3)}},
+	}
+
+	w := new(fakeResponseWriter)
+	q := new(Msg)
+	q.SetQuestion("miek.nl.", TypeIXFR)
+
+	tr := new(Transfer)
+	if err := tr.OutIXFR(w, q, soa, 1, diffs); err != ErrIxfrTooBig {
+		t.Fatalf("expected ErrIxfrTooBig, got %v", err)
+	}
+}
+
+// TestOutIXFRFraming checks that a normal (non-TooBig) multi-diff chain is emitted as the
+// RFC 1995 (old SOA, deletions, new SOA, additions)+ sequence, framed by the zone's current
+// SOA at the start and the end.
+func TestOutIXFRFraming(t *testing.T) {
+	soa := testSOA("miek.nl.", 3)
+	rm1 := testSOA("rm1.miek.nl.", 101)
+	add1 := testSOA("add1.miek.nl.", 102)
+	rm2 := testSOA("rm2.miek.nl.", 103)
+	add2 := testSOA("add2.miek.nl.", 104)
+	diffs := []IxfrDiff{
+		{NewSerial: 2, Remove: []RR{rm1}, Add: []RR{add1}},
+		{NewSerial: 3, Remove: []RR{rm2}, Add: []RR{add2}},
+	}
+
+	w := new(fakeResponseWriter)
+	q := new(Msg)
+	q.SetQuestion("miek.nl.", TypeIXFR)
+
+	tr := new(Transfer)
+	if err := tr.OutIXFR(w, q, soa, 1, diffs); err != nil {
+		t.Fatalf("OutIXFR failed: %s", err)
+	}
+
+	if len(w.msgs) != 1 {
+		t.Fatalf("expected the whole diff chain to fit in one message, got %d", len(w.msgs))
+	}
+	want := []RR{soa, testSOA("miek.nl.", 1), rm1, testSOA("miek.nl.", 2), add1, testSOA("miek.nl.", 2), rm2, testSOA("miek.nl.", 3), add2, soa}
+	got := w.msgs[0].Answer
+	if len(got) != len(want) {
+		t.Fatalf("expected %d RRs in the envelope, got %d", len(want), len(got))
+	}
+	for i := range want {
+		gotSOA, gotOK := got[i].(*SOA)
+		wantSOA, wantOK := want[i].(*SOA)
+		if gotOK != wantOK {
+			t.Fatalf("RR %d: expected SOA-ness %v, got %v", i, wantOK, gotOK)
+		}
+		if wantOK {
+			if gotSOA.Serial != wantSOA.Serial {
+				t.Fatalf("RR %d: expected SOA serial %d, got %d", i, wantSOA.Serial, gotSOA.Serial)
+			}
+			continue
+		}
+		if got[i] != want[i] {
+			t.Fatalf("RR %d: expected %v, got %v", i, want[i], got[i])
+		}
+	}
+}